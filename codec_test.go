@@ -0,0 +1,38 @@
+package rpc
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGobCodec(t *testing.T) {
+	server := NewServer(new(Arith))
+	server.RegisterCodec(GobServerCodec())
+	http.Handle("/rpc-gob", server)
+	go http.ListenAndServe(":1239", nil)
+
+	client := NewClientPath(http.DefaultClient, "http://localhost:1239", "/rpc-gob", WithCodec(GobClientCodec()))
+
+	var C int
+	if err := client.Call(2, "Add", 3, 4, &C); err != nil {
+		t.Errorf("client.Call failed: %v", err)
+	} else if C != 7 {
+		t.Errorf("C should be 7, got %d", C)
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	server := NewServer(new(Arith))
+	server.RegisterCodec(MsgpackServerCodec())
+	http.Handle("/rpc-msgpack", server)
+	go http.ListenAndServe(":1240", nil)
+
+	client := NewClientPath(http.DefaultClient, "http://localhost:1240", "/rpc-msgpack", WithCodec(MsgpackClientCodec()))
+
+	var C int
+	if err := client.Call(2, "Sub", 10, 4, &C); err != nil {
+		t.Errorf("client.Call failed: %v", err)
+	} else if C != 6 {
+		t.Errorf("C should be 6, got %d", C)
+	}
+}
@@ -0,0 +1,40 @@
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// setDeadlineHeader sets DeadlineHeader on req from ctx's deadline, if any,
+// for contextFromRequest to read back on the server side.
+func setDeadlineHeader(req *http.Request, ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(DeadlineHeader, deadline.Format(time.RFC3339Nano))
+	}
+}
+
+/*
+	DeadlineHeader is the HTTP header CallContext sets to propagate a
+	ctx.Deadline() to the server, and that contextFromRequest reads back on
+	the way in.
+*/
+const DeadlineHeader = "X-RPC-Deadline"
+
+// contextFromRequest builds the context.Context a method declaring one
+// should see: r's own context (context.Background() if r is nil, e.g. a
+// batched JSON-RPC sub-request), merged with any deadline the client sent
+// in DeadlineHeader. The returned cancel func must be called once the
+// request is done to release the deadline timer.
+func contextFromRequest(r *http.Request) (context.Context, context.CancelFunc) {
+	base := context.Background()
+	if r != nil {
+		base = r.Context()
+		if hdr := r.Header.Get(DeadlineHeader); hdr != "" {
+			if deadline, err := time.Parse(time.RFC3339Nano, hdr); err == nil {
+				return context.WithDeadline(base, deadline)
+			}
+		}
+	}
+	return base, func() {}
+}
@@ -0,0 +1,69 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Echoer int
+
+func (*Echoer) Ping(ctx context.Context) string {
+	if _, ok := ctx.Deadline(); ok {
+		return "deadline"
+	}
+	return "no-deadline"
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	RegisterPath(new(Echoer), "/rpc-context")
+	go http.ListenAndServe(":1243", nil)
+
+	client := NewClientPath(http.DefaultClient, "http://localhost:1243", "/rpc-context")
+
+	var got string
+	if err := client.Call(0, "Ping", &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if got != "no-deadline" {
+		t.Errorf("got %q, want no-deadline", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := client.CallContext(ctx, 0, "Ping", &got); err != nil {
+		t.Fatalf("CallContext failed: %v", err)
+	}
+	if got != "deadline" {
+		t.Errorf("got %q, want deadline", got)
+	}
+}
+
+func TestServerMiddleware(t *testing.T) {
+	server := NewServer(new(Arith))
+	var calls int32
+	server.Use(func(next Handler) Handler {
+		return func(ctx context.Context, method string, in []json.RawMessage) ([]json.RawMessage, error) {
+			atomic.AddInt32(&calls, 1)
+			return next(ctx, method, in)
+		}
+	})
+	http.Handle("/rpc-middleware", server)
+	go http.ListenAndServe(":1244", nil)
+
+	client := NewClientPath(http.DefaultClient, "http://localhost:1244", "/rpc-middleware")
+
+	var C int
+	if err := client.Call(2, "Add", 1, 2, &C); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if C != 3 {
+		t.Errorf("C should be 3")
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("middleware should have run once, got %d", calls)
+	}
+}
@@ -0,0 +1,393 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/daviddengcn/go-villa"
+)
+
+/*
+jsonRPCVersion is the only protocol version this package understands.
+*/
+const jsonRPCVersion = "2.0"
+
+// Reserved error codes as defined by the JSON-RPC 2.0 specification.
+const (
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCMethodNotFound = -32601
+	jsonRPCInvalidParams  = -32602
+	jsonRPCInternalError  = -32603
+)
+
+// errCodeToJSONRPC maps this package's ErrCode* constants onto the
+// reserved JSON-RPC 2.0 error codes.
+func errCodeToJSONRPC(code int) int {
+	switch code {
+	case ErrCodeUnknownMethod:
+		return jsonRPCMethodNotFound
+	case ErrCodeInvalidParams:
+		return jsonRPCInvalidParams
+	case ErrCodeParseError:
+		return jsonRPCParseError
+	}
+	return jsonRPCInternalError
+}
+
+type jsonRPCRequest struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+func (req *jsonRPCRequest) isNotification() bool {
+	return len(req.ID) == 0
+}
+
+type jsonRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type jsonRPCResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+func newJSONRPCErrorResponse(id json.RawMessage, code int, message string) *jsonRPCResponse {
+	return &jsonRPCResponse{
+		Jsonrpc: jsonRPCVersion,
+		Error:   &jsonRPCError{Code: code, Message: message},
+		ID:      id,
+	}
+}
+
+/*
+JSONRPCServer serves registered methods over the JSON-RPC 2.0 wire
+format, as an alternative to the form-encoded Server. A single HTTP
+request may carry either one request object or a batch (JSON array) of
+them.
+*/
+type JSONRPCServer struct {
+	oValue     reflect.Value
+	methods    map[string]*methodInfo
+	paramNames map[string][]string
+}
+
+/*
+NewJSONRPCServer creates a *JSONRPCServer for o, whose exported methods
+are dispatched by name. Since reflection does not preserve Go parameter
+names, named (object-form) params are matched against the names
+registered with SetParamNames; methods with no registered names only
+accept positional (array-form) params.
+*/
+func NewJSONRPCServer(o interface{}) *JSONRPCServer {
+	return &JSONRPCServer{
+		oValue:     reflect.ValueOf(o),
+		methods:    methodTable(o),
+		paramNames: make(map[string][]string),
+	}
+}
+
+/*
+SetParamNames registers the parameter names of method, in declaration
+order, so that named (object-form) JSON-RPC params can be matched to
+them. It is the registration hook mentioned in JSONRPCServer's doc.
+*/
+func (s *JSONRPCServer) SetParamNames(method string, names ...string) {
+	s.paramNames[method] = names
+}
+
+// Implementation of http.Handler.
+func (s *JSONRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body := json.NewDecoder(r.Body)
+	body.UseNumber()
+
+	var raw json.RawMessage
+	if err := body.Decode(&raw); err != nil {
+		json.NewEncoder(w).Encode(newJSONRPCErrorResponse(nil, jsonRPCParseError, err.Error()))
+		return
+	}
+
+	trimmed := strings.TrimSpace(string(raw))
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		s.serveBatch(w, raw)
+		return
+	}
+
+	resp := s.dispatch(r, raw)
+	if resp != nil {
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func (s *JSONRPCServer) serveBatch(w http.ResponseWriter, raw json.RawMessage) {
+	var reqs []json.RawMessage
+	if err := json.Unmarshal(raw, &reqs); err != nil {
+		json.NewEncoder(w).Encode(newJSONRPCErrorResponse(nil, jsonRPCParseError, err.Error()))
+		return
+	}
+
+	if len(reqs) == 0 {
+		json.NewEncoder(w).Encode(newJSONRPCErrorResponse(nil, jsonRPCInvalidRequest, "empty batch"))
+		return
+	}
+
+	resps := make([]*jsonRPCResponse, len(reqs))
+	var wg sync.WaitGroup
+	wg.Add(len(reqs))
+	for i, one := range reqs {
+		go func(i int, one json.RawMessage) {
+			defer wg.Done()
+			resps[i] = nil
+			if resp := s.dispatch(nil, one); resp != nil {
+				resps[i] = resp
+			}
+		}(i, one)
+	}
+	wg.Wait()
+
+	out := make([]*jsonRPCResponse, 0, len(resps))
+	for _, resp := range resps {
+		if resp != nil {
+			out = append(out, resp)
+		}
+	}
+
+	// A batch of nothing but notifications produces no response objects;
+	// per the spec the server returns nothing at all, not an empty array.
+	if len(out) == 0 {
+		return
+	}
+
+	json.NewEncoder(w).Encode(out)
+}
+
+// dispatch decodes and executes a single JSON-RPC request object, returning
+// the response to write or nil if req was a notification and produces none.
+func (s *JSONRPCServer) dispatch(r *http.Request, raw json.RawMessage) *jsonRPCResponse {
+	var req jsonRPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return newJSONRPCErrorResponse(nil, jsonRPCInvalidRequest, err.Error())
+	}
+
+	respond := func(resp *jsonRPCResponse) *jsonRPCResponse {
+		if req.isNotification() {
+			return nil
+		}
+		return resp
+	}
+
+	respondErr := func(rpcErr RpcError) *jsonRPCResponse {
+		return respond(newJSONRPCErrorResponse(req.ID, errCodeToJSONRPC(rpcErr.Code), rpcErr.Info))
+	}
+
+	if req.Jsonrpc != jsonRPCVersion {
+		return respond(newJSONRPCErrorResponse(req.ID, jsonRPCInvalidRequest, "unsupported jsonrpc version: "+req.Jsonrpc))
+	}
+
+	mi := s.methods[req.Method]
+	if mi == nil {
+		return respondErr(RpcError{Code: ErrCodeUnknownMethod, Info: "Unknown method: " + req.Method})
+	}
+
+	ins, err := s.decodeParams(&req, mi)
+	if err != nil {
+		return respondErr(RpcError{Code: ErrCodeInvalidParams, Info: err.Error()})
+	}
+
+	ctx, cancel := contextFromRequest(r)
+	defer cancel()
+
+	outs, hasPanic, info := invokeMethod(s.oValue, mi, r, ctx, ins)
+
+	if hasPanic {
+		return respondErr(RpcError{Code: ErrCodePanic, Info: info})
+	}
+
+	var result interface{}
+	switch len(outs) {
+	case 0:
+		result = nil
+	case 1:
+		result = outs[0].Interface()
+	default:
+		vals := make([]interface{}, len(outs))
+		for i := range outs {
+			vals[i] = outs[i].Interface()
+		}
+		result = vals
+	}
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return respondErr(RpcError{Code: ErrCodeServerError, Info: err.Error()})
+	}
+
+	return respond(&jsonRPCResponse{
+		Jsonrpc: jsonRPCVersion,
+		Result:  resultJson,
+		ID:      req.ID,
+	})
+}
+
+// decodeParams unmarshals req.Params into mi's declared input types,
+// accepting either a positional array or a named object (matched against
+// names registered with SetParamNames).
+func (s *JSONRPCServer) decodeParams(req *jsonRPCRequest, mi *methodInfo) ([]reflect.Value, error) {
+	ins := make([]reflect.Value, len(mi.inTypes))
+
+	if len(req.Params) == 0 || string(req.Params) == "null" {
+		if len(mi.inTypes) != 0 {
+			return nil, fmt.Errorf("method %s expects %d params, got 0", req.Method, len(mi.inTypes))
+		}
+		return ins, nil
+	}
+
+	trimmed := strings.TrimSpace(string(req.Params))
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		names := s.paramNames[req.Method]
+		if len(names) != len(mi.inTypes) {
+			return nil, fmt.Errorf("method %s has no registered param names for named params", req.Method)
+		}
+
+		var named map[string]json.RawMessage
+		if err := json.Unmarshal(req.Params, &named); err != nil {
+			return nil, err
+		}
+
+		for i, name := range names {
+			pv := reflect.New(mi.inTypes[i])
+			if raw, ok := named[name]; ok {
+				if err := json.Unmarshal(raw, pv.Interface()); err != nil {
+					return nil, err
+				}
+			}
+			ins[i] = reflect.Indirect(pv)
+		}
+		return ins, nil
+	}
+
+	var positional []json.RawMessage
+	if err := json.Unmarshal(req.Params, &positional); err != nil {
+		return nil, err
+	}
+	if len(positional) != len(mi.inTypes) {
+		return nil, fmt.Errorf("method %s expects %d params, got %d", req.Method, len(mi.inTypes), len(positional))
+	}
+	for i := range mi.inTypes {
+		pv := reflect.New(mi.inTypes[i])
+		if err := json.Unmarshal(positional[i], pv.Interface()); err != nil {
+			return nil, err
+		}
+		ins[i] = reflect.Indirect(pv)
+	}
+	return ins, nil
+}
+
+/*
+JSONRPCClient is a client for the JSON-RPC 2.0 wire format.
+*/
+type JSONRPCClient struct {
+	httpClient *http.Client
+	url        string
+	nextID     int64
+}
+
+/*
+NewJSONRPCClient creates a *JSONRPCClient posting requests to url.
+*/
+func NewJSONRPCClient(httpClient *http.Client, url string) *JSONRPCClient {
+	return &JSONRPCClient{
+		httpClient: httpClient,
+		url:        url,
+	}
+}
+
+/*
+Call invokes method with params (either a slice for positional params or
+a map/struct for named params), decoding the result into result.
+*/
+func (c *JSONRPCClient) Call(method string, params interface{}, result interface{}) error {
+	paramsJson, err := json.Marshal(params)
+	if err != nil {
+		return villa.NestErrorf(err, "Call(%s) Marshal params", method)
+	}
+
+	id := atomic.AddInt64(&c.nextID, 1)
+	idJson, _ := json.Marshal(id)
+
+	reqJson, err := json.Marshal(&jsonRPCRequest{
+		Jsonrpc: jsonRPCVersion,
+		Method:  method,
+		Params:  paramsJson,
+		ID:      idJson,
+	})
+	if err != nil {
+		return villa.NestErrorf(err, "Call(%s) Marshal request", method)
+	}
+
+	resp, err := c.httpClient.Post(c.url, "application/json", bytes.NewReader(reqJson))
+	if err != nil {
+		return villa.NestErrorf(err, "Call(%s) Post", method)
+	}
+	defer resp.Body.Close()
+
+	var res jsonRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return villa.NestErrorf(err, "Call(%s) Decode response", method)
+	}
+
+	if res.Error != nil {
+		return RpcError{Code: res.Error.Code, Info: res.Error.Message}
+	}
+
+	if result != nil && len(res.Result) > 0 {
+		if err := json.Unmarshal(res.Result, result); err != nil {
+			return villa.NestErrorf(err, "Call(%s) Unmarshal result", method)
+		}
+	}
+
+	return nil
+}
+
+/*
+Notify invokes method like Call but as a notification: no id is sent and
+no response is expected.
+*/
+func (c *JSONRPCClient) Notify(method string, params interface{}) error {
+	paramsJson, err := json.Marshal(params)
+	if err != nil {
+		return villa.NestErrorf(err, "Notify(%s) Marshal params", method)
+	}
+
+	reqJson, err := json.Marshal(&jsonRPCRequest{
+		Jsonrpc: jsonRPCVersion,
+		Method:  method,
+		Params:  paramsJson,
+	})
+	if err != nil {
+		return villa.NestErrorf(err, "Notify(%s) Marshal request", method)
+	}
+
+	resp, err := c.httpClient.Post(c.url, "application/json", bytes.NewReader(reqJson))
+	if err != nil {
+		return villa.NestErrorf(err, "Notify(%s) Post", method)
+	}
+	resp.Body.Close()
+
+	return nil
+}
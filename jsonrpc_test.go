@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJSONRPCBasic(t *testing.T) {
+	/** Server **/
+	http.Handle("/jsonrpc", NewJSONRPCServer(new(Arith)))
+	go http.ListenAndServe(":1237", nil)
+
+	/** Client **/
+	client := NewJSONRPCClient(http.DefaultClient, "http://localhost:1237/jsonrpc")
+
+	var C int
+	err := client.Call("Add", []int{1, 2}, &C)
+	if err != nil {
+		t.Errorf("client.Call failed: %v", err)
+	} else if C != 3 {
+		t.Errorf("C should be 3, got %d", C)
+	}
+
+	err = client.Call("NoSuchMethod", []int{1, 2}, &C)
+	if err == nil {
+		t.Errorf("client.Call should have failed")
+	} else if rpcErr, ok := err.(RpcError); !ok || rpcErr.Code != jsonRPCMethodNotFound {
+		t.Errorf("expected method-not-found error, got %v", err)
+	}
+}
+
+func TestJSONRPCNamedParams(t *testing.T) {
+	server := NewJSONRPCServer(new(Arith))
+	server.SetParamNames("Add", "a", "b")
+	http.Handle("/jsonrpc-named", server)
+	go http.ListenAndServe(":1238", nil)
+
+	client := NewJSONRPCClient(http.DefaultClient, "http://localhost:1238/jsonrpc-named")
+
+	var C int
+	err := client.Call("Add", map[string]int{"a": 4, "b": 5}, &C)
+	if err != nil {
+		t.Errorf("client.Call failed: %v", err)
+	} else if C != 9 {
+		t.Errorf("C should be 9, got %d", C)
+	}
+}
+
+func TestJSONRPCInvalidVersion(t *testing.T) {
+	http.Handle("/jsonrpc-version", NewJSONRPCServer(new(Arith)))
+	go http.ListenAndServe(":1250", nil)
+
+	resp, err := http.Post("http://localhost:1250/jsonrpc-version", "application/json",
+		strings.NewReader(`{"jsonrpc":"9.9","method":"Add","params":[1,2],"id":1}`))
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var res jsonRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if res.Error == nil || res.Error.Code != jsonRPCInvalidRequest {
+		t.Errorf("expected invalid-request error, got %+v", res.Error)
+	}
+}
+
+func TestJSONRPCBatchAllNotifications(t *testing.T) {
+	http.Handle("/jsonrpc-batch-notify", NewJSONRPCServer(new(Arith)))
+	go http.ListenAndServe(":1251", nil)
+
+	resp, err := http.Post("http://localhost:1251/jsonrpc-batch-notify", "application/json",
+		strings.NewReader(`[{"jsonrpc":"2.0","method":"Add","params":[1,2]}]`))
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(body) != 0 {
+		t.Errorf("expected empty body for an all-notification batch, got %q", body)
+	}
+}
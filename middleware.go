@@ -0,0 +1,258 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+Handler is the unit of work a Middleware wraps: given the raw JSON
+arguments of a call to method, it returns the raw JSON return values or
+an error. Operating on json.RawMessage rather than a method's concrete Go
+types lets middleware (logging, metrics, auth, rate limiting, tracing)
+plug in without knowing anything about the methods it's wrapping.
+*/
+type Handler func(ctx context.Context, method string, in []json.RawMessage) (out []json.RawMessage, err error)
+
+/*
+Middleware wraps a Handler with additional behavior, calling next to
+continue the chain.
+*/
+type Middleware func(next Handler) Handler
+
+/*
+Use appends mw to the chain middleware.go runs ordinary calls through,
+innermost call last. Only the form-encoded JSON codec's non-streaming
+calls go through it (see rawJSONArgsCodec); gob, msgpack and streaming
+methods bypass it, since their wire format isn't a []json.RawMessage
+request/response pair. Middleware runs in registration order: the first
+one added to s is outermost and sees the call first.
+*/
+func (s *Server) Use(mw Middleware) {
+	s.middlewares = append(s.middlewares, mw)
+}
+
+// rawJSONArgsCodec is implemented by codecs whose arguments travel as
+// JSON, letting Server's middleware chain run over them as
+// []json.RawMessage without decoding into a method's concrete Go types.
+type rawJSONArgsCodec interface {
+	RawJSONArgs(r *http.Request, n int) []json.RawMessage
+}
+
+// chain builds the Handler that decodes, invokes and re-encodes mi on
+// oValue, with r available to the method if it needs one, wrapped by
+// every middleware registered with Use in registration order (first
+// registered, outermost).
+func (s *Server) chain(oValue reflect.Value, r *http.Request, mi *methodInfo) Handler {
+	h := s.invoke(oValue, r, mi)
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	return h
+}
+
+// invoke is the innermost Handler of the middleware chain: it decodes in
+// into mi's declared argument types, calls the method through
+// invokeMethod, and re-encodes its return values.
+func (s *Server) invoke(oValue reflect.Value, r *http.Request, mi *methodInfo) Handler {
+	return func(ctx context.Context, method string, in []json.RawMessage) ([]json.RawMessage, error) {
+		args := make([]reflect.Value, len(mi.inTypes))
+		for i := range mi.inTypes {
+			pInV := reflect.New(mi.inTypes[i])
+			if i < len(in) {
+				if err := json.Unmarshal(in[i], pInV.Interface()); err != nil {
+					return nil, RpcError{Code: ErrCodeInvalidParams, Info: err.Error()}
+				}
+			}
+			args[i] = reflect.Indirect(pInV)
+		}
+
+		outs, hasPanic, info := invokeMethod(oValue, mi, r, ctx, args)
+		if hasPanic {
+			return nil, RpcError{Code: ErrCodePanic, Info: info}
+		}
+
+		outJsons := make([]json.RawMessage, len(outs))
+		for i := range outs {
+			outJson, err := json.Marshal(outs[i].Interface())
+			if err != nil {
+				return nil, RpcError{Code: ErrCodeServerError, Info: err.Error()}
+			}
+			outJsons[i] = outJson
+		}
+		return outJsons, nil
+	}
+}
+
+/*
+ClientHandler is Client's analogue of Handler: given the raw JSON
+arguments of a call to method, it performs the call and returns the raw
+JSON return values or an error.
+*/
+type ClientHandler func(ctx context.Context, method string, in []json.RawMessage) (out []json.RawMessage, err error)
+
+/*
+ClientMiddleware wraps a ClientHandler with additional behavior, calling
+next to continue the chain.
+*/
+type ClientMiddleware func(next ClientHandler) ClientHandler
+
+/*
+Use appends mw to the chain Call and CallContext run a request through,
+in registration order (first registered, outermost). Like Server.Use, it
+only takes effect for the default form-encoded JSON codec; a Client built
+with WithCodec ignores it.
+*/
+func (c *Client) Use(mw ClientMiddleware) {
+	c.middlewares = append(c.middlewares, mw)
+}
+
+// clientChain builds the ClientHandler that performs the HTTP round trip,
+// wrapped by every middleware registered with Use in registration order
+// (first registered, outermost).
+func (c *Client) clientChain() ClientHandler {
+	h := c.roundTrip
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		h = c.middlewares[i](h)
+	}
+	return h
+}
+
+// roundTrip is the innermost ClientHandler of the client middleware
+// chain: it posts in as the call's form-encoded JSON arguments and
+// returns the server's return values as raw JSON.
+func (c *Client) roundTrip(ctx context.Context, method string, in []json.RawMessage) ([]json.RawMessage, error) {
+	ins := make([]interface{}, len(in))
+	for i := range in {
+		ins[i] = in[i]
+	}
+
+	resp, err := c.postRequest(ctx, method, ins)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, RpcError{Code: ErrCodeServerError, Info: http.StatusText(resp.StatusCode)}
+	}
+
+	var res rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Code != ErrCodeOk {
+		return nil, RpcError{Code: res.Code, Info: res.Info}
+	}
+
+	out := make([]json.RawMessage, len(res.Outs))
+	for i := range res.Outs {
+		out[i] = json.RawMessage(res.Outs[i])
+	}
+	return out, nil
+}
+
+/*
+RecoverMiddleware returns a Middleware that recovers a panic raised by the
+rest of the chain it wraps (middleware registered after it, which runs
+inside it), logging it with its stack trace via
+log.Printf and reporting it as an RpcError with code ErrCodePanic rather
+than crashing the handler goroutine. invokeMethod already recovers panics
+from the method itself, so this is mainly a safety net for user-supplied
+middleware.
+*/
+func RecoverMiddleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, method string, in []json.RawMessage) (out []json.RawMessage, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("rpc: panic in %s: %v\n%s", method, r, debug.Stack())
+					err = RpcError{Code: ErrCodePanic, Info: "panic in " + method}
+				}
+			}()
+			return next(ctx, method, in)
+		}
+	}
+}
+
+/*
+AccessLogMiddleware returns a Middleware that logs one line per call via
+logger, recording the method name, its wall-clock duration and the error
+it returned, if any.
+*/
+func AccessLogMiddleware(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, method string, in []json.RawMessage) ([]json.RawMessage, error) {
+			start := time.Now()
+			out, err := next(ctx, method, in)
+			logger.Printf("method=%s duration=%s error=%v", method, time.Since(start), err)
+			return out, err
+		}
+	}
+}
+
+/*
+PrometheusMiddleware returns a Middleware that counts calls and records
+their latency under the "rpc" namespace: rpc_requests_total, partitioned
+by method and status ("ok" or "error"), and rpc_request_duration_seconds,
+partitioned by method. It registers both collectors with the default
+registry itself; calling it more than once is safe and reuses the
+collectors already registered by an earlier call rather than panicking.
+*/
+func PrometheusMiddleware() Middleware {
+	requestsTotal := registerOrReuseCounterVec(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rpc",
+		Name:      "requests_total",
+		Help:      "Total number of RPC calls, by method and status.",
+	}, []string{"method", "status"}))
+	requestDuration := registerOrReuseHistogramVec(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rpc",
+		Name:      "request_duration_seconds",
+		Help:      "RPC call latency in seconds, by method.",
+	}, []string{"method"}))
+
+	return func(next Handler) Handler {
+		return func(ctx context.Context, method string, in []json.RawMessage) ([]json.RawMessage, error) {
+			start := time.Now()
+			out, err := next(ctx, method, in)
+			requestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+			status := "ok"
+			if err != nil {
+				status = "error"
+			}
+			requestsTotal.WithLabelValues(method, status).Inc()
+			return out, err
+		}
+	}
+}
+
+// registerOrReuseCounterVec registers cv with the default registry, or, if an
+// equivalent CounterVec is already registered (e.g. PrometheusMiddleware was
+// called before), returns that existing one instead of panicking.
+func registerOrReuseCounterVec(cv *prometheus.CounterVec) *prometheus.CounterVec {
+	if err := prometheus.Register(cv); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.CounterVec)
+		}
+		panic(err)
+	}
+	return cv
+}
+
+// registerOrReuseHistogramVec is registerOrReuseCounterVec for HistogramVec.
+func registerOrReuseHistogramVec(hv *prometheus.HistogramVec) *prometheus.HistogramVec {
+	if err := prometheus.Register(hv); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.HistogramVec)
+		}
+		panic(err)
+	}
+	return hv
+}
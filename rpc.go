@@ -36,6 +36,8 @@
 package rpc
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/daviddengcn/go-villa"
 	"fmt"
@@ -43,21 +45,63 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"strings"
 )
 
 type methodInfo struct {
 	funcValue   reflect.Value
 	needRequest bool
+	needContext bool
 	inTypes     []reflect.Type
+
+	// stream, streamElemType and emitterPos describe a streaming method;
+	// see stream.go. stream is streamNone for an ordinary method.
+	stream         streamKind
+	streamElemType reflect.Type
+	emitterPos     int
+}
+
+// service bundles a registered object with its method table, the unit
+// RegisterName keys by name.
+type service struct {
+	oValue  reflect.Value
+	methods map[string]*methodInfo
 }
 
 /*
 	Server represents an instance for server. *Server satisfies http.Handler
-	interface.
+	interface. It can host several registered objects at once, each under
+	its own service name (see RegisterName); a client addresses their
+	methods as "Service.Method". NewServer/Register/RegisterPath register
+	their object under the empty service name, so a bare method name (no
+	"." prefix) keeps resolving to it, unchanged from before RegisterName
+	existed.
 */
 type Server struct {
-	oValue  reflect.Value
-	methods map[string]*methodInfo
+	services    map[string]*service
+	codecs      map[string]ServerCodec
+	middlewares []Middleware
+}
+
+// resolve looks up the (receiver, *methodInfo) pair a wire method name
+// names: "Service.Method" is split on the last '.' into a service name
+// and a bare method; a name with no '.' is looked up in the unnamed
+// default service registered by NewServer/Register/RegisterPath.
+func (s *Server) resolve(mname string) (reflect.Value, *methodInfo, error) {
+	name, method := "", mname
+	if i := strings.LastIndex(mname, "."); i >= 0 {
+		name, method = mname[:i], mname[i+1:]
+	}
+
+	svc, ok := s.services[name]
+	if !ok {
+		return reflect.Value{}, nil, RpcError{Code: ErrCodeUnknownService, Info: name}
+	}
+	mi := svc.methods[method]
+	if mi == nil {
+		return reflect.Value{}, nil, RpcError{Code: ErrCodeUnknownMethod, Info: mname}
+	}
+	return svc.oValue, mi, nil
 }
 
 /*
@@ -66,10 +110,13 @@ type Server struct {
 const DefaultPath = "/_http_rpc"
 
 const (
-	ErrCodeOk            int = iota // Ok
-	ErrCodeUnknownMethod            // Unknown method name
-	ErrCodePanic                    // panic in a call
-	ErrCodeServerError              // http code is not 200
+	ErrCodeOk             int = iota // Ok
+	ErrCodeUnknownMethod             // Unknown method name
+	ErrCodePanic                     // panic in a call
+	ErrCodeServerError               // http code is not 200
+	ErrCodeParseError                // request body could not be parsed
+	ErrCodeInvalidParams             // params did not match the method's signature
+	ErrCodeUnknownService            // "Service.Method" named a service that was never registered
 )
 
 type RpcError struct {
@@ -87,6 +134,12 @@ func (err RpcError) Error() string {
 		return "Panic in call: " + err.Info
 	case ErrCodeServerError:
 		return "Server error: " + err.Info
+	case ErrCodeParseError:
+		return "Parse error: " + err.Info
+	case ErrCodeInvalidParams:
+		return "Invalid params: " + err.Info
+	case ErrCodeUnknownService:
+		return "Unknown service: " + err.Info
 	}
 	return fmt.Sprintf("Rpc Error: code = %d, info = %s", err.Code, err.Info)
 }
@@ -104,78 +157,116 @@ func (res *rpcResponse) writeTo(w io.Writer) {
 
 /**** Server ****/
 
+// invokeMethod calls mi's underlying function with oValue as the receiver,
+// r as the optional leading *http.Request, ctx as the optional
+// context.Context following it, and args bound to its remaining declared
+// inputs. A panic inside the call is recovered and reported through
+// hasPanic/info rather than propagated. It is shared by every wire format
+// this package serves, so they all dispatch methods the same way.
+func invokeMethod(oValue reflect.Value, mi *methodInfo, r *http.Request, ctx context.Context, args []reflect.Value) (outs []reflect.Value, hasPanic bool, info string) {
+	callArr := make([]reflect.Value, 1, len(args)+3)
+	callArr[0] = oValue
+
+	if mi.needRequest {
+		callArr = append(callArr, reflect.ValueOf(r))
+	}
+	if mi.needContext {
+		callArr = append(callArr, reflect.ValueOf(ctx))
+	}
+	callArr = append(callArr, args...)
+
+	defer func() {
+		if err := recover(); err != nil {
+			hasPanic = true
+			info = fmt.Sprint(err)
+		}
+	}()
+	outs = mi.funcValue.Call(callArr)
+	return
+}
+
 // Implementation of http.Handler
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	mname := r.FormValue("method")
+	codec := s.codecFor(r)
 
-	mi := s.methods[mname]
-	if mi == nil {
-		(&rpcResponse{
-			Code: ErrCodeUnknownMethod,
-			Info: mname,
-		}).writeTo(w)
+	mname, decodeArg, err := codec.ReadRequest(r)
+	if err != nil {
+		codec.WriteError(w, RpcError{Code: ErrCodeParseError, Info: err.Error()})
 		return
 	}
 
-	// plus 1 for the receiver, and needRequest
-	callArr := make([]reflect.Value, 1, len(mi.inTypes)+2)
-	callArr[0] = s.oValue
+	if mname == servicesIntrospectionMethod {
+		codec.WriteResponse(w, []interface{}{s.Services()})
+		return
+	}
 
-	if mi.needRequest {
-		callArr = append(callArr, reflect.ValueOf(r))
+	oValue, mi, err := s.resolve(mname)
+	if err != nil {
+		codec.WriteError(w, err.(RpcError))
+		return
 	}
 
-	inJsons := r.Form["in"]
-	// set parameters
+	ctx, cancel := contextFromRequest(r)
+	defer cancel()
+
+	if mi.stream == streamNone && len(s.middlewares) > 0 {
+		if raw, ok := codec.(rawJSONArgsCodec); ok {
+			in := raw.RawJSONArgs(r, len(mi.inTypes))
+			outJsons, err := s.chain(oValue, r, mi)(ctx, mname, in)
+			if err != nil {
+				if rpcErr, ok := err.(RpcError); ok {
+					codec.WriteError(w, rpcErr)
+				} else {
+					codec.WriteError(w, RpcError{Code: ErrCodeServerError, Info: err.Error()})
+				}
+				return
+			}
+			outVals := make([]interface{}, len(outJsons))
+			for i := range outJsons {
+				outVals[i] = outJsons[i]
+			}
+			codec.WriteResponse(w, outVals)
+			return
+		}
+	}
+
+	args := make([]reflect.Value, len(mi.inTypes))
 	for i := range mi.inTypes {
 		pInV := reflect.New(mi.inTypes[i])
-		json.Unmarshal([]byte(inJsons[i]), pInV.Interface())
-		callArr = append(callArr, reflect.Indirect(pInV))
+		decodeArg(i, pInV.Interface())
+		args[i] = reflect.Indirect(pInV)
 	}
 
-	outs, hasPanic, info := func() (outs []reflect.Value, hasPanic bool, info string) {
-		defer func() {
-			if err := recover(); err != nil {
-				hasPanic = true
-				info = fmt.Sprint(err)
-			}
-		}()
-		outs = mi.funcValue.Call(callArr)
+	if mi.stream != streamNone {
+		s.serveStream(w, r, ctx, oValue, mi, args)
 		return
-	}()
+	}
+
+	outs, hasPanic, info := invokeMethod(oValue, mi, r, ctx, args)
 
 	if hasPanic {
-		(&rpcResponse{
-			Code: ErrCodePanic,
-			Info: info,
-		}).writeTo(w)
+		codec.WriteError(w, RpcError{Code: ErrCodePanic, Info: info})
 		return
 	}
 
-	outJsons := make([]string, len(outs))
+	outVals := make([]interface{}, len(outs))
 	for i := range outs {
-		outJson, _ := json.Marshal(outs[i].Interface())
-		outJsons[i] = string(outJson)
+		outVals[i] = outs[i].Interface()
 	}
-	(&rpcResponse{
-		Code: ErrCodeOk,
-		Outs: outJsons,
-	}).writeTo(w)
+	codec.WriteResponse(w, outVals)
 }
 
 var (
 	pHttpRequestType reflect.Type = reflect.TypeOf((*http.Request)(nil))
+	contextType      reflect.Type = reflect.TypeOf((*context.Context)(nil)).Elem()
 )
 
-/*
-	NewServer creates a *Server instance for an object o, whose methods are
-	called for RPC service.
-*/
-func NewServer(o interface{}) *Server {
-	server := &Server{
-		oValue:  reflect.ValueOf(o),
-		methods: make(map[string]*methodInfo),
-	}
+// methodTable builds the name -> *methodInfo map for o by reflecting over
+// its exported methods. It is shared by NewServer and the alternative
+// codecs (e.g. the JSON-RPC 2.0 server) so they agree on how methods are
+// discovered and how *http.Request is recognized as a leading parameter.
+func methodTable(o interface{}) map[string]*methodInfo {
+	methods := make(map[string]*methodInfo)
 
 	oType := reflect.TypeOf(o)
 	for m := 0; m < oType.NumMethod(); m++ {
@@ -192,6 +283,11 @@ func NewServer(o interface{}) *Server {
 				first++
 			}
 
+			if first < tp.NumIn() && tp.In(first) == contextType {
+				mi.needContext = true
+				first++
+			}
+
 			if tp.NumIn() > first {
 				mi.inTypes = make([]reflect.Type, tp.NumIn()-first)
 				for i := range mi.inTypes {
@@ -199,10 +295,39 @@ func NewServer(o interface{}) *Server {
 				}
 			}
 		}
-		server.methods[method.Name] = mi
+		methods[method.Name] = mi
 	}
 
-	return server
+	return methods
+}
+
+/*
+	NewServer creates a *Server instance for an object o, whose methods are
+	called for RPC service. o is registered under the empty service name,
+	so its methods are reached by their bare name; use RegisterName to host
+	additional objects under "Service.Method" names on the same Server.
+*/
+func NewServer(o interface{}) *Server {
+	s := &Server{}
+	s.RegisterName("", o)
+	return s
+}
+
+/*
+	RegisterName adds o to s as a service, reachable as "name.Method". An
+	empty name is the default service NewServer registers, reachable by
+	bare method name; registering another object under "" replaces it.
+*/
+func (s *Server) RegisterName(name string, o interface{}) {
+	methods := methodTable(o)
+	detectStreaming(reflect.TypeOf(o), methods)
+	if s.services == nil {
+		s.services = make(map[string]*service)
+	}
+	s.services[name] = &service{
+		oValue:  reflect.ValueOf(o),
+		methods: methods,
+	}
 }
 
 /*
@@ -225,25 +350,34 @@ func RegisterPath(o interface{}, path string) {
 	Client represents an RPC client.
 */
 type Client struct {
-	httpClient *http.Client
-	host       string
+	httpClient  *http.Client
+	host        string
+	codec       ClientCodec
+	middlewares []ClientMiddleware
 }
 
 /*
 	NewClient creates a *Client with DefaultPath
 */
-func NewClient(httpClient *http.Client, host string) *Client {
-	return NewClientPath(httpClient, host, DefaultPath)
+func NewClient(httpClient *http.Client, host string, opts ...ClientOption) *Client {
+	return NewClientPath(httpClient, host, DefaultPath, opts...)
 }
 
 /*
-	NewClientPath creates a *Client with specified path.
+	NewClientPath creates a *Client with specified path. By default the
+	client speaks the original form-encoded JSON wire format; pass
+	WithCodec to use a different ClientCodec (e.g. gob or msgpack).
 */
-func NewClientPath(httpClient *http.Client, host, path string) *Client {
-	return &Client{
+func NewClientPath(httpClient *http.Client, host, path string, opts ...ClientOption) *Client {
+	c := &Client{
 		httpClient: httpClient,
 		host:       host + path,
+		codec:      formJSONClientCodec{},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 /*
@@ -256,50 +390,137 @@ func NewClientPath(httpClient *http.Client, host, path string) *Client {
 
 	If the first parameter of the Method is a *http.Request, it has totally 4
 	parameters.
+
+	If the server hosts more than one object (see Server.RegisterName),
+	method must be "Service.Method"; a bare name only reaches the object
+	registered under the empty service name.
 */
 func (c *Client) Call(numIn int, method string, inPOuts ...interface{}) error {
-	inJsons := make([]string, numIn)
-	for i := range inJsons {
-		inJson, err := json.Marshal(inPOuts[i])
-		if err != nil {
-			return villa.NestErrorf(err, "Call(%s) Marshal inPOuts[%d]", method, i)
+	return c.call(context.Background(), numIn, method, inPOuts...)
+}
+
+/*
+	CallContext makes an RPC like Call, but ctx additionally governs the
+	call: if ctx has a deadline, it is serialized into the X-RPC-Deadline
+	header for the server to merge into the method's context.Context
+	parameter (see methodTable), and if ctx is done before the HTTP
+	round-trip finishes, the request is aborted and ctx.Err() is returned.
+*/
+func (c *Client) CallContext(ctx context.Context, numIn int, method string, inPOuts ...interface{}) error {
+	return c.call(ctx, numIn, method, inPOuts...)
+}
+
+// call is shared by Call and CallContext. When c has client middleware
+// registered and is using the default form-encoded JSON codec, it runs
+// the call through clientChain instead of postRequest directly, mirroring
+// Server's middleware scope limitation (see middleware.go).
+func (c *Client) call(ctx context.Context, numIn int, method string, inPOuts ...interface{}) error {
+	ins := inPOuts[:numIn]
+	outs := inPOuts[numIn:]
+
+	if _, isFormJSON := c.codec.(formJSONClientCodec); isFormJSON && len(c.middlewares) > 0 {
+		inJsons := make([]json.RawMessage, len(ins))
+		for i := range ins {
+			inJson, err := json.Marshal(ins[i])
+			if err != nil {
+				return villa.NestErrorf(err, "Call(%s) Marshal inPOuts[%d]", method, i)
+			}
+			inJsons[i] = inJson
 		}
 
-		inJsons[i] = string(inJson)
+		outJsons, err := c.clientChain()(ctx, method, inJsons)
+		if err != nil {
+			if rpcErr, ok := err.(RpcError); ok {
+				return rpcErr
+			}
+			return err
+		}
+		for i := range outJsons {
+			if i >= len(outs) {
+				break
+			}
+			if err := json.Unmarshal(outJsons[i], outs[i]); err != nil {
+				return villa.NestErrorf(err, "Call(%s) Unmarshal outs[%d]", method, i)
+			}
+		}
+		return nil
 	}
-	resp, err := c.httpClient.PostForm(c.host, url.Values{
-		"method": {method},
-		"in":     inJsons,
-	})
+
+	resp, err := c.postRequest(ctx, method, ins)
 	if err != nil {
-		return villa.NestErrorf(err, "Call(%s) PostFrom", method)
+		return err
 	}
+
 	if resp.StatusCode != 200 {
 		return RpcError{
 			Code: ErrCodeServerError,
 			Info: fmt.Sprintf("Http status code: %d", resp.StatusCode),
 		}
 	}
-
 	defer resp.Body.Close()
 
-	dec := json.NewDecoder(resp.Body)
-	var res rpcResponse
-	err = dec.Decode(&res)
-	if err != nil {
-		return villa.NestErrorf(err, "Call(%s) Decode response", method)
+	if err := c.codec.DecodeResponse(resp, outs); err != nil {
+		if rpcErr, ok := err.(RpcError); ok {
+			return rpcErr
+		}
+		return villa.NestErrorf(err, "Call(%s) DecodeResponse", method)
 	}
 
-	if res.Code != ErrCodeOk {
-		return RpcError{Code: res.Code, Info: res.Info}
-	}
+	return nil
+}
 
-	for i := range res.Outs {
-		err := json.Unmarshal([]byte(res.Outs[i]), inPOuts[numIn+i])
+// postRequest encodes ins with c.codec and posts them to method under ctx,
+// returning the raw HTTP response. The form-encoded JSON codec is
+// special-cased because it predates the ClientCodec abstraction and posts
+// form values rather than a single encoded body. If ctx has a deadline, it
+// is sent as the X-RPC-Deadline header for the server to pick up.
+func (c *Client) postRequest(ctx context.Context, method string, ins []interface{}) (*http.Response, error) {
+	if _, isFormJSON := c.codec.(formJSONClientCodec); isFormJSON {
+		inJsons := make([]string, len(ins))
+		for i := range ins {
+			inJson, err := json.Marshal(ins[i])
+			if err != nil {
+				return nil, villa.NestErrorf(err, "Call(%s) Marshal inPOuts[%d]", method, i)
+			}
+			inJsons[i] = string(inJson)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.host, nil)
 		if err != nil {
-			return villa.NestErrorf(err, "Call(%s) Unmarshal Outs[%d]", method, i)
+			return nil, villa.NestErrorf(err, "Call(%s) NewRequest", method)
 		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.PostForm = url.Values{
+			"method": {method},
+			"in":     inJsons,
+		}
+		req.Body = io.NopCloser(bytes.NewReader([]byte(req.PostForm.Encode())))
+		setDeadlineHeader(req, ctx)
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, villa.NestErrorf(err, "Call(%s) PostForm", method)
+		}
+		return resp, nil
 	}
 
-	return nil
+	body, err := c.codec.EncodeRequest(method, ins)
+	if err != nil {
+		return nil, villa.NestErrorf(err, "Call(%s) EncodeRequest", method)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.host, bytes.NewReader(body))
+	if err != nil {
+		return nil, villa.NestErrorf(err, "Call(%s) NewRequest", method)
+	}
+	req.Header.Set("Content-Type", c.codec.ContentType())
+	setDeadlineHeader(req, ctx)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, villa.NestErrorf(err, "Call(%s) Post", method)
+	}
+	return resp, nil
 }
@@ -0,0 +1,61 @@
+package rpc
+
+import "sort"
+
+// servicesIntrospectionMethod is a built-in method every Server answers
+// regardless of what's registered, returning its own Services(). It lives
+// outside any service's namespace so it can never collide with a
+// registered method.
+const servicesIntrospectionMethod = "_rpc.services"
+
+/*
+MethodSignature describes one registered method's name and the Go types
+of its parameters and return values, as found by reflection. In lists
+only the parameters a client passes: a leading *http.Request,
+context.Context or a streaming method's func(T) error emitter is left out.
+*/
+type MethodSignature struct {
+	Name string
+	In   []string
+	Out  []string
+}
+
+/*
+ServiceInfo describes one service registered with RegisterName (or the
+unnamed default service NewServer/Register set up) and its methods.
+*/
+type ServiceInfo struct {
+	Name    string
+	Methods []MethodSignature
+}
+
+/*
+Services returns introspection info about every service registered on s,
+sorted by name, for debug UIs and code generators. It backs the built-in
+"_rpc.services" method.
+*/
+func (s *Server) Services() []ServiceInfo {
+	infos := make([]ServiceInfo, 0, len(s.services))
+	for name, svc := range s.services {
+		oType := svc.oValue.Type()
+		methods := make([]MethodSignature, 0, len(svc.methods))
+		for mname, mi := range svc.methods {
+			in := make([]string, len(mi.inTypes))
+			for i, t := range mi.inTypes {
+				in[i] = t.String()
+			}
+			var out []string
+			if m, ok := oType.MethodByName(mname); ok {
+				out = make([]string, m.Type.NumOut())
+				for i := range out {
+					out[i] = m.Type.Out(i).String()
+				}
+			}
+			methods = append(methods, MethodSignature{Name: mname, In: in, Out: out})
+		}
+		sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+		infos = append(infos, ServiceInfo{Name: name, Methods: methods})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
@@ -0,0 +1,54 @@
+package rpc
+
+import (
+	"net/http"
+	"testing"
+)
+
+type Mult int
+
+func (*Mult) Times(a, b int) int {
+	return a * b
+}
+
+func TestRegisterNameDispatch(t *testing.T) {
+	server := NewServer(new(Arith))
+	server.RegisterName("Mult", new(Mult))
+	http.Handle("/rpc-services", server)
+	go http.ListenAndServe(":1245", nil)
+
+	client := NewClientPath(http.DefaultClient, "http://localhost:1245", "/rpc-services")
+
+	var C int
+	if err := client.Call(2, "Add", 1, 2, &C); err != nil {
+		t.Fatalf("Call(Add) failed: %v", err)
+	}
+	if C != 3 {
+		t.Errorf("C should be 3, got %d", C)
+	}
+
+	if err := client.Call(2, "Mult.Times", 3, 4, &C); err != nil {
+		t.Fatalf("Call(Mult.Times) failed: %v", err)
+	}
+	if C != 12 {
+		t.Errorf("C should be 12, got %d", C)
+	}
+
+	err := client.Call(2, "NoSuchService.Foo", 1, 2, &C)
+	rpcErr, ok := err.(RpcError)
+	if !ok || rpcErr.Code != ErrCodeUnknownService {
+		t.Errorf("expected ErrCodeUnknownService, got %v", err)
+	}
+
+	var infos []ServiceInfo
+	if err := client.Call(0, servicesIntrospectionMethod, &infos); err != nil {
+		t.Fatalf("Call(%s) failed: %v", servicesIntrospectionMethod, err)
+	}
+	names := make(map[string]bool)
+	for _, info := range infos {
+		names[info.Name] = true
+	}
+	if !names[""] || !names["Mult"] {
+		t.Errorf("expected services \"\" and Mult, got %v", infos)
+	}
+}
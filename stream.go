@@ -0,0 +1,207 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/daviddengcn/go-villa"
+)
+
+// streamKind distinguishes the two ways a method can declare itself
+// streaming, detected by detectStreaming.
+type streamKind int
+
+const (
+	streamNone      streamKind = iota
+	streamChanOut              // last return value is a <-chan T
+	streamEmitterIn            // one parameter is a func(T) error emitter
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// detectStreaming annotates methods, built by methodTable for oType, with
+// their streamKind: a method whose last return value is a <-chan T, or
+// that accepts a func(T) error among its parameters, streams its results
+// instead of returning a single buffered value. See Server.serveStream and
+// Client.CallStream.
+func detectStreaming(oType reflect.Type, methods map[string]*methodInfo) {
+	for m := 0; m < oType.NumMethod(); m++ {
+		method := oType.Method(m)
+		mi := methods[method.Name]
+		tp := method.Type
+
+		if tp.NumOut() > 0 {
+			last := tp.Out(tp.NumOut() - 1)
+			if last.Kind() == reflect.Chan && last.ChanDir() != reflect.SendDir {
+				mi.stream = streamChanOut
+				mi.streamElemType = last.Elem()
+				continue
+			}
+		}
+
+		first := 1 // tp.In(0) is the receiver
+		if mi.needRequest {
+			first++
+		}
+		if mi.needContext {
+			first++
+		}
+		for i := first; i < tp.NumIn(); i++ {
+			in := tp.In(i)
+			if in.Kind() == reflect.Func && in.NumIn() == 1 && in.NumOut() == 1 && in.Out(0) == errorType {
+				mi.stream = streamEmitterIn
+				mi.streamElemType = in.In(0)
+				mi.emitterPos = i - first
+				mi.inTypes = append(mi.inTypes[:mi.emitterPos], mi.inTypes[mi.emitterPos+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// streamFrame is one newline-delimited JSON frame of a streaming response.
+// A non-terminal frame (Done == false) carries one emitted value in Out;
+// the terminal frame carries the final status instead.
+type streamFrame struct {
+	Done bool
+	Code int
+	Info string
+	Out  json.RawMessage `json:",omitempty"`
+}
+
+// serveStream drives a streaming method (see detectStreaming), writing one
+// newline-delimited JSON frame per emitted value followed by a terminal
+// status frame, flushing after each so the client sees them as they
+// happen.
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request, ctx context.Context, oValue reflect.Value, mi *methodInfo, args []reflect.Value) {
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	writeFrame := func(f *streamFrame) {
+		enc.Encode(f)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	switch mi.stream {
+	case streamChanOut:
+		outs, hasPanic, info := invokeMethod(oValue, mi, r, ctx, args)
+		if hasPanic {
+			writeFrame(&streamFrame{Done: true, Code: ErrCodePanic, Info: info})
+			return
+		}
+
+		ch := outs[len(outs)-1]
+		for {
+			v, ok := ch.Recv()
+			if !ok {
+				break
+			}
+			itemJson, err := json.Marshal(v.Interface())
+			if err != nil {
+				writeFrame(&streamFrame{Done: true, Code: ErrCodeServerError, Info: err.Error()})
+				return
+			}
+			writeFrame(&streamFrame{Out: itemJson})
+		}
+		writeFrame(&streamFrame{Done: true, Code: ErrCodeOk})
+
+	case streamEmitterIn:
+		emitterType := reflect.FuncOf([]reflect.Type{mi.streamElemType}, []reflect.Type{errorType}, false)
+		emitter := reflect.MakeFunc(emitterType, func(in []reflect.Value) []reflect.Value {
+			itemJson, err := json.Marshal(in[0].Interface())
+			if err != nil {
+				return []reflect.Value{reflect.ValueOf(err).Convert(errorType)}
+			}
+			writeFrame(&streamFrame{Out: itemJson})
+			return []reflect.Value{reflect.Zero(errorType)}
+		})
+
+		callArgs := make([]reflect.Value, 0, len(args)+1)
+		callArgs = append(callArgs, args[:mi.emitterPos]...)
+		callArgs = append(callArgs, emitter)
+		callArgs = append(callArgs, args[mi.emitterPos:]...)
+
+		outs, hasPanic, info := invokeMethod(oValue, mi, r, ctx, callArgs)
+		if hasPanic {
+			writeFrame(&streamFrame{Done: true, Code: ErrCodePanic, Info: info})
+			return
+		}
+
+		code, info := ErrCodeOk, ""
+		if len(outs) > 0 {
+			if errVal, _ := outs[len(outs)-1].Interface().(error); errVal != nil {
+				code, info = ErrCodeServerError, errVal.Error()
+			}
+		}
+		writeFrame(&streamFrame{Done: true, Code: code, Info: info})
+	}
+}
+
+/*
+CallStream makes a streaming RPC. Like Call, numIn distinguishes the
+positional parameters from the rest of inAndCallback, whose last element
+must be a func(T) error invoked once per value the server emits. It
+returns once the server sends its terminal frame, the callback returns
+an error, or the connection fails.
+
+	client.CallStream(2, "Tail", path, fromLine, func(line string) error {
+	    fmt.Println(line)
+	    return nil
+	})
+*/
+func (c *Client) CallStream(numIn int, method string, inAndCallback ...interface{}) error {
+	if len(inAndCallback) != numIn+1 {
+		return fmt.Errorf("CallStream(%s): expected %d args plus a callback, got %d", method, numIn, len(inAndCallback))
+	}
+
+	cbVal := reflect.ValueOf(inAndCallback[numIn])
+	cbType := cbVal.Type()
+	if cbType.Kind() != reflect.Func || cbType.NumIn() != 1 || cbType.NumOut() != 1 || cbType.Out(0) != errorType {
+		return fmt.Errorf("CallStream(%s): last argument must be a func(T) error", method)
+	}
+
+	resp, err := c.postRequest(context.Background(), method, inAndCallback[:numIn])
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return RpcError{
+			Code: ErrCodeServerError,
+			Info: fmt.Sprintf("Http status code: %d", resp.StatusCode),
+		}
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	elemType := cbType.In(0)
+	for {
+		var frame streamFrame
+		if err := dec.Decode(&frame); err != nil {
+			return villa.NestErrorf(err, "CallStream(%s) Decode frame", method)
+		}
+
+		if frame.Done {
+			if frame.Code != ErrCodeOk {
+				return RpcError{Code: frame.Code, Info: frame.Info}
+			}
+			return nil
+		}
+
+		itemPtr := reflect.New(elemType)
+		if err := json.Unmarshal(frame.Out, itemPtr.Interface()); err != nil {
+			return villa.NestErrorf(err, "CallStream(%s) Unmarshal item", method)
+		}
+
+		if errVal, _ := cbVal.Call([]reflect.Value{reflect.Indirect(itemPtr)})[0].Interface().(error); errVal != nil {
+			return errVal
+		}
+	}
+}
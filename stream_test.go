@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+type Counter int
+
+func (*Counter) CountTo(n int) <-chan int {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		for i := 1; i <= n; i++ {
+			ch <- i
+		}
+	}()
+	return ch
+}
+
+func (*Counter) EmitTo(n int, emit func(int) error) error {
+	for i := 1; i <= n; i++ {
+		if err := emit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EmitToCtx exercises a streaming method that also declares a
+// context.Context parameter, so detectStreaming must still find the
+// emitter at the right position among its *remaining* args.
+func (*Counter) EmitToCtx(ctx context.Context, n int, emit func(int) error) error {
+	for i := 1; i <= n; i++ {
+		if err := emit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCallStreamChanOut(t *testing.T) {
+	RegisterPath(new(Counter), "/rpc-stream-chan")
+	go http.ListenAndServe(":1241", nil)
+
+	client := NewClientPath(http.DefaultClient, "http://localhost:1241", "/rpc-stream-chan")
+
+	var got []int
+	err := client.CallStream(1, "CountTo", 3, func(v int) error {
+		got = append(got, v)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("CallStream failed: %v", err)
+	}
+	if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Errorf("unexpected values: %v", got)
+	}
+}
+
+func TestCallStreamEmitterIn(t *testing.T) {
+	RegisterPath(new(Counter), "/rpc-stream-emit")
+	go http.ListenAndServe(":1242", nil)
+
+	client := NewClientPath(http.DefaultClient, "http://localhost:1242", "/rpc-stream-emit")
+
+	var got []int
+	err := client.CallStream(1, "EmitTo", 3, func(v int) error {
+		got = append(got, v)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("CallStream failed: %v", err)
+	}
+	if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Errorf("unexpected values: %v", got)
+	}
+}
+
+func TestCallStreamEmitterInWithContext(t *testing.T) {
+	RegisterPath(new(Counter), "/rpc-stream-emit-ctx")
+	go http.ListenAndServe(":1246", nil)
+
+	client := NewClientPath(http.DefaultClient, "http://localhost:1246", "/rpc-stream-emit-ctx")
+
+	var got []int
+	err := client.CallStream(1, "EmitToCtx", 3, func(v int) error {
+		got = append(got, v)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("CallStream failed: %v", err)
+	}
+	if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Errorf("unexpected values: %v", got)
+	}
+}
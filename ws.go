@@ -0,0 +1,408 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daviddengcn/go-villa"
+	"github.com/gorilla/websocket"
+)
+
+// cancelMethod is the notification sent by CallContext when its context is
+// cancelled. The server treats it as an ordinary notification, so it is a
+// no-op until a method is actually interruptible.
+const cancelMethod = "rpc.cancel"
+
+/*
+Upgrader is used by ServeWS to upgrade incoming HTTP connections. It is
+exported so callers can tune it (e.g. CheckOrigin) before serving.
+*/
+var Upgrader = websocket.Upgrader{}
+
+/*
+ServeWS upgrades r to a WebSocket connection and serves JSON-RPC 2.0
+requests framed as individual text messages on it. Each message is
+dispatched in its own goroutine, so independent requests do not block
+each other; writes are serialized through a single writer goroutine, as
+required by the websocket single-writer rule. ServeWS blocks until the
+connection is closed.
+*/
+func (s *JSONRPCServer) ServeWS(w http.ResponseWriter, r *http.Request) error {
+	conn, err := Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return villa.NestErrorf(err, "ServeWS Upgrade")
+	}
+	defer conn.Close()
+
+	writeCh := make(chan []byte, 16)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for msg := range writeCh {
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(data []byte) {
+			defer wg.Done()
+			resp := s.dispatch(r, data)
+			if resp == nil {
+				return
+			}
+			if b, err := json.Marshal(resp); err == nil {
+				select {
+				case writeCh <- b:
+				case <-writerDone:
+				}
+			}
+		}(data)
+	}
+	wg.Wait()
+	close(writeCh)
+	<-writerDone
+
+	return nil
+}
+
+/*
+ErrClientClosed is returned by WSClient.Call and CallContext once the
+client has been closed, for any call already in flight or issued
+afterwards.
+*/
+var ErrClientClosed = RpcError{Code: ErrCodeServerError, Info: "WSClient is closed"}
+
+/*
+ErrConnLost is returned by WSClient.Call and CallContext for a call that
+was still in flight when the underlying connection dropped. The new
+connection reconnect() establishes has no memory of it, so rather than
+leave it hanging until ctx or Close, or silently resend it, it is failed
+immediately: the caller decides whether re-issuing it is safe.
+*/
+var ErrConnLost = RpcError{Code: ErrCodeServerError, Info: "WSClient lost its connection; call was not retried"}
+
+/*
+WSClient is a client for the JSON-RPC 2.0 wire format over a single
+long-lived WebSocket connection, allowing many in-flight calls to be
+multiplexed and server-initiated notifications to be received.
+*/
+type WSClient struct {
+	url    string
+	dialer *websocket.Dialer
+
+	notify func(method string, params json.RawMessage)
+
+	writeCh   chan []byte
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	pending map[int64]chan *jsonRPCResponse
+	nextID  int64
+}
+
+/*
+NewWSClient dials url and returns a *WSClient ready to make calls. The
+connection is kept alive in the background, reconnecting with an
+exponential backoff if it drops.
+*/
+func NewWSClient(url string) (*WSClient, error) {
+	c := &WSClient{
+		url:     url,
+		dialer:  websocket.DefaultDialer,
+		writeCh: make(chan []byte, 16),
+		closeCh: make(chan struct{}),
+		pending: make(map[int64]chan *jsonRPCResponse),
+	}
+
+	if err := c.dial(); err != nil {
+		return nil, villa.NestErrorf(err, "NewWSClient dial")
+	}
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	return c, nil
+}
+
+func (c *WSClient) dial() error {
+	conn, _, err := c.dialer.Dial(c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	return nil
+}
+
+// reconnect keeps redialing with exponential backoff (capped at 30s) until
+// it succeeds or the client is closed.
+func (c *WSClient) reconnect() bool {
+	backoff := 100 * time.Millisecond
+	for {
+		select {
+		case <-c.closeCh:
+			return false
+		default:
+		}
+
+		if err := c.dial(); err == nil {
+			return true
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-c.closeCh:
+			return false
+		}
+
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+/*
+SetNotificationHandler registers h to be called, in its own goroutine,
+for every incoming message that has no matching pending call (i.e. a
+server-initiated notification rather than a reply).
+*/
+func (c *WSClient) SetNotificationHandler(h func(method string, params json.RawMessage)) {
+	c.mu.Lock()
+	c.notify = h
+	c.mu.Unlock()
+}
+
+func (c *WSClient) writeLoop() {
+	for {
+		select {
+		case msg := <-c.writeCh:
+			c.mu.Lock()
+			conn := c.conn
+			c.mu.Unlock()
+			if conn != nil {
+				conn.WriteMessage(websocket.TextMessage, msg)
+			}
+		case <-c.closeCh:
+			return
+		}
+	}
+}
+
+func (c *WSClient) readLoop() {
+	for {
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-c.closeCh:
+				// Close is already failing every pending call with
+				// ErrClientClosed; nothing more to do here.
+				return
+			default:
+			}
+
+			// The connection dropped out from under any in-flight calls.
+			// reconnect() gives us a new connection, not the old one's
+			// state, so those calls are failed now rather than hung
+			// until ctx/Close or silently resent on the new connection.
+			c.failPending(ErrConnLost)
+			if !c.reconnect() {
+				return
+			}
+			continue
+		}
+
+		var resp jsonRPCResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			continue
+		}
+
+		if len(resp.ID) == 0 {
+			c.handleNotification(data)
+			continue
+		}
+
+		var id int64
+		if err := json.Unmarshal(resp.ID, &id); err != nil {
+			c.handleNotification(data)
+			continue
+		}
+
+		c.mu.Lock()
+		ch := c.pending[id]
+		c.mu.Unlock()
+		if ch != nil {
+			sendResponse(ch, &resp)
+		} else {
+			c.handleNotification(data)
+		}
+	}
+}
+
+func (c *WSClient) handleNotification(data []byte) {
+	var req jsonRPCRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	h := c.notify
+	c.mu.Unlock()
+	if h != nil {
+		go h(req.Method, req.Params)
+	}
+}
+
+// failPending delivers rpcErr to every currently pending call and clears
+// the pending map, used by both Close (ErrClientClosed) and readLoop
+// (ErrConnLost) to fail calls in flight.
+func (c *WSClient) failPending(rpcErr RpcError) {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[int64]chan *jsonRPCResponse)
+	c.mu.Unlock()
+
+	resp := &jsonRPCResponse{Error: &jsonRPCError{Code: rpcErr.Code, Message: rpcErr.Info}}
+	for _, ch := range pending {
+		sendResponse(ch, resp)
+	}
+}
+
+// sendResponse delivers resp to ch without blocking. CallContext reads at
+// most one reply per call (the rest of its select gives up via
+// ctx.Done()/closeCh instead), so if failPending and a genuine reply from
+// readLoop race for the same id, the loser here is simply dropped instead
+// of leaking a goroutine blocked on a full, unread channel.
+func sendResponse(ch chan *jsonRPCResponse, resp *jsonRPCResponse) {
+	select {
+	case ch <- resp:
+	default:
+	}
+}
+
+/*
+Call invokes method on the server with the given params, decoding the
+result into result. It is equivalent to CallContext with a context that
+never expires.
+*/
+func (c *WSClient) Call(method string, params interface{}, result interface{}) error {
+	return c.CallContext(context.Background(), method, params, result)
+}
+
+/*
+CallContext invokes method like Call, but aborts and sends a "rpc.cancel"
+notification to the server if ctx is done before a reply arrives.
+*/
+func (c *WSClient) CallContext(ctx context.Context, method string, params interface{}, result interface{}) error {
+	paramsJson, err := json.Marshal(params)
+	if err != nil {
+		return villa.NestErrorf(err, "CallContext(%s) Marshal params", method)
+	}
+
+	id := atomic.AddInt64(&c.nextID, 1)
+	idJson, _ := json.Marshal(id)
+
+	reqJson, err := json.Marshal(&jsonRPCRequest{
+		Jsonrpc: jsonRPCVersion,
+		Method:  method,
+		Params:  paramsJson,
+		ID:      idJson,
+	})
+	if err != nil {
+		return villa.NestErrorf(err, "CallContext(%s) Marshal request", method)
+	}
+
+	ch := make(chan *jsonRPCResponse, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	select {
+	case c.writeCh <- reqJson:
+	case <-c.closeCh:
+		return ErrClientClosed
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return RpcError{Code: resp.Error.Code, Info: resp.Error.Message}
+		}
+		if result != nil && len(resp.Result) > 0 {
+			if err := json.Unmarshal(resp.Result, result); err != nil {
+				return villa.NestErrorf(err, "CallContext(%s) Unmarshal result", method)
+			}
+		}
+		return nil
+
+	case <-ctx.Done():
+		c.sendCancel(id)
+		return ctx.Err()
+
+	case <-c.closeCh:
+		return ErrClientClosed
+	}
+}
+
+func (c *WSClient) sendCancel(id int64) {
+	paramsJson, _ := json.Marshal([]int64{id})
+	reqJson, err := json.Marshal(&jsonRPCRequest{
+		Jsonrpc: jsonRPCVersion,
+		Method:  cancelMethod,
+		Params:  paramsJson,
+	})
+	if err != nil {
+		return
+	}
+
+	select {
+	case c.writeCh <- reqJson:
+	case <-c.closeCh:
+	default:
+	}
+}
+
+/*
+Close shuts the connection down, failing every pending call with
+ErrClientClosed.
+*/
+func (c *WSClient) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn != nil {
+			err = conn.Close()
+		}
+		c.failPending(ErrClientClosed)
+	})
+	return err
+}
@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSClientCallRoundTrip(t *testing.T) {
+	server := NewJSONRPCServer(new(Arith))
+	http.HandleFunc("/ws-rpc", func(w http.ResponseWriter, r *http.Request) {
+		server.ServeWS(w, r)
+	})
+	go http.ListenAndServe(":1247", nil)
+
+	client, err := NewWSClient("ws://localhost:1247/ws-rpc")
+	if err != nil {
+		t.Fatalf("NewWSClient failed: %v", err)
+	}
+	defer client.Close()
+
+	var C int
+	if err := client.Call("Add", []int{1, 2}, &C); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if C != 3 {
+		t.Errorf("C should be 3, got %d", C)
+	}
+}
+
+func TestWSClientNotification(t *testing.T) {
+	http.HandleFunc("/ws-notify", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"tick","params":"hello"}`))
+		time.Sleep(200 * time.Millisecond)
+	})
+	go http.ListenAndServe(":1248", nil)
+
+	client, err := NewWSClient("ws://localhost:1248/ws-notify")
+	if err != nil {
+		t.Fatalf("NewWSClient failed: %v", err)
+	}
+	defer client.Close()
+
+	got := make(chan string, 1)
+	client.SetNotificationHandler(func(method string, params json.RawMessage) {
+		got <- method
+	})
+
+	select {
+	case method := <-got:
+		if method != "tick" {
+			t.Errorf("got method %q, want tick", method)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for notification")
+	}
+}
+
+func TestWSClientCloseFailsPending(t *testing.T) {
+	block := make(chan struct{})
+	http.HandleFunc("/ws-block", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage() // read the call, never reply
+		<-block
+	})
+	go http.ListenAndServe(":1249", nil)
+
+	client, err := NewWSClient("ws://localhost:1249/ws-block")
+	if err != nil {
+		t.Fatalf("NewWSClient failed: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		var result int
+		errCh <- client.Call("Add", []int{1, 2}, &result)
+	}()
+
+	time.Sleep(100 * time.Millisecond) // let the call reach c.pending
+	if err := client.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	close(block)
+
+	select {
+	case err := <-errCh:
+		if rpcErr, ok := err.(RpcError); !ok || rpcErr != ErrClientClosed {
+			t.Errorf("got %v, want ErrClientClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Call to fail")
+	}
+}